@@ -22,12 +22,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"log"
-	"net/http"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
 const (
@@ -35,9 +39,17 @@ const (
 )
 
 var (
-	universalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+	scheme = runtime.NewScheme()
+	codecs = serializer.NewCodecFactory(scheme)
+
+	universalDeserializer = codecs.UniversalDeserializer()
 )
 
+func init() {
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+}
+
 // patchOperation is an operation of a JSON patch, see https://tools.ietf.org/html/rfc6902 .
 type patchOperation struct {
 	Op    string      `json:"op"`
@@ -45,89 +57,201 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-// admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
-// operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*v1beta1.AdmissionRequest) ([]patchOperation, error)
+// Request is a version-agnostic wrapper around an incoming AdmissionRequest. Regardless of whether the apiserver
+// sent an admission.k8s.io/v1 or admission.k8s.io/v1beta1 AdmissionReview, the request handed to admitFunc is
+// normalized to the v1 AdmissionRequest shape.
+type Request struct {
+	admissionv1.AdmissionRequest
+}
 
-// doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
-// request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
-// bytes.
-func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) ([]byte, error) {
+// admitFunc is a callback for admission controller logic. Given a Request, it returns a Response describing whether
+// the object is allowed, any patch operations to apply, and any Warnings, Result detail, or AuditAnnotations to
+// surface back to the apiserver.
+type admitFunc func(Request) Response
+
+// v1beta1AdmissionRequestToV1 converts a v1beta1 AdmissionRequest to its v1 equivalent. The two types are
+// structurally identical; only the group/version of the containing AdmissionReview differs.
+func v1beta1AdmissionRequestToV1(in *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+// v1AdmissionResponseToV1beta1 converts a v1 AdmissionResponse to its v1beta1 equivalent, so the webhook can reply
+// using the same apiVersion the apiserver sent the request in.
+func v1AdmissionResponseToV1beta1(in *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	if in == nil {
+		return nil
+	}
+	var patchType *v1beta1.PatchType
+	if in.PatchType != nil {
+		t := v1beta1.PatchType(*in.PatchType)
+		patchType = &t
+	}
+	return &v1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		PatchType:        patchType,
+		AuditAnnotations: in.AuditAnnotations,
+		Warnings:         in.Warnings,
+	}
+}
+
+// decodeAdmissionReview validates the HTTP request and parses the AdmissionReview body, negotiating whichever
+// admission.k8s.io apiVersion the apiserver sent it in. It is shared by the mutating and validating webhook paths.
+func decodeAdmissionReview(w http.ResponseWriter, r *http.Request) (Request, schema.GroupVersionKind, error) {
 	// Step 1: Request validation. Only handle POST requests with a body and json content type.
 
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		return nil, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
+		return Request{}, schema.GroupVersionKind{}, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not read request body: %v", err)
+		return Request{}, schema.GroupVersionKind{}, fmt.Errorf("could not read request body: %v", err)
 	}
 
 	if contentType := r.Header.Get("Content-Type"); contentType != jsonContentType {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
+		return Request{}, schema.GroupVersionKind{}, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
+	// Step 2: Parse the AdmissionReview request, negotiating the apiVersion it was sent with.
 
-	var admissionReviewReq v1beta1.AdmissionReview
+	obj, gvk, err := universalDeserializer.Decode(body, nil, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return Request{}, schema.GroupVersionKind{}, fmt.Errorf("could not deserialize request: %v", err)
+	}
 
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+	var admissionReviewReq admissionv1.AdmissionReview
+	switch review := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		admissionReviewReq = *review
+	case *v1beta1.AdmissionReview:
+		admissionReviewReq.Request = v1beta1AdmissionRequestToV1(review.Request)
+	default:
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not deserialize request: %v", err)
-	} else if admissionReviewReq.Request == nil {
+		return Request{}, schema.GroupVersionKind{}, fmt.Errorf("unsupported AdmissionReview group/version/kind: %v", gvk)
+	}
+
+	if admissionReviewReq.Request == nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, errors.New("malformed admission review: request is nil")
+		return Request{}, schema.GroupVersionKind{}, errors.New("malformed admission review: request is nil")
 	}
 
-	// Step 3: Construct the AdmissionReview response.
+	return Request{AdmissionRequest: *admissionReviewReq.Request}, *gvk, nil
+}
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		Response: &v1beta1.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
+// encodeAdmissionReview marshals review as JSON, converting it to the v1beta1 wire shape first if that's the
+// apiVersion the request arrived in.
+func encodeAdmissionReview(gvk schema.GroupVersionKind, review admissionv1.AdmissionReview) ([]byte, error) {
+	var bytes []byte
+	var err error
+	if gvk.Version == v1beta1.SchemeGroupVersion.Version {
+		bytes, err = json.Marshal(&v1beta1.AdmissionReview{
+			TypeMeta: review.TypeMeta,
+			Response: v1AdmissionResponseToV1beta1(review.Response),
+		})
+	} else {
+		bytes, err = json.Marshal(&review)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("marshaling response: %v", err)
+	}
+	return bytes, nil
+}
 
-	var patchOps []patchOperation
-	patchOps, err = admit(admissionReviewReq.Request)
-
+// doServeAdmitFunc parses the HTTP request for a mutating admission controller webhook, and -- in case of a
+// well-formed request -- delegates the admission control logic to the given admitFunc. The response body is then
+// returned as raw bytes. Both admission.k8s.io/v1 and admission.k8s.io/v1beta1 AdmissionReview requests are accepted;
+// the response echoes back whichever apiVersion the request arrived in.
+func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) ([]byte, error) {
+	req, gvk, err := decodeAdmissionReview(w, r)
 	if err != nil {
-		// If the handler returned an error, incorporate the error message into the response and deny the object
-		// creation.
-		admissionReviewResponse.Response.Allowed = false
-		admissionReviewResponse.Response.Result = &metav1.Status{
-			Message: err.Error(),
-		}
-	} else {
-		// Otherwise, encode the patch operations to JSON and return a positive response.
-		patchBytes, err := json.Marshal(patchOps)
+		return nil, err
+	}
+
+	resp := admit(req)
+	resp.UID = req.UID
+
+	if resp.Allowed && len(resp.Patches) > 0 {
+		patchBytes, err := json.Marshal(resp.Patches)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
 		}
-		admissionReviewResponse.Response.Allowed = true
-		admissionReviewResponse.Response.Patch = patchBytes
+		resp.Patch = patchBytes
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.PatchType = &patchType
+	}
+
+	logAdmitResult(req, resp)
+
+	admissionReviewResponse := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+		},
+		Response: &resp.AdmissionResponse,
 	}
 
-	// Return the AdmissionReview with a response as JSON.
-	bytes, err := json.Marshal(&admissionReviewResponse)
+	bytes, err := encodeAdmissionReview(gvk, admissionReviewResponse)
 	if err != nil {
-		return nil, fmt.Errorf("marshaling response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
 	}
 	return bytes, nil
 }
 
-// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
+// logAdmitResult logs the outcome of an admit call, at a severity matching the returned Result.Code: allowed
+// requests and client-side denials (4xx) are logged as informational, while 5xx codes indicate the handler itself
+// failed and are logged as errors.
+func logAdmitResult(req Request, resp Response) {
+	switch {
+	case resp.Allowed:
+		log.Printf("admission allowed for %s %s/%s", req.Resource, req.Namespace, req.Name)
+	case resp.Result != nil && resp.Result.Code >= http.StatusInternalServerError:
+		log.Printf("admission errored for %s %s/%s: %s", req.Resource, req.Namespace, req.Name, resp.Result.Message)
+	default:
+		msg := "denied"
+		if resp.Result != nil {
+			msg = resp.Result.Message
+		}
+		log.Printf("admission denied for %s %s/%s: %s", req.Resource, req.Namespace, req.Name, msg)
+	}
+}
+
+// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging. doServeAdmitFunc only
+// returns an error for requests it could not parse or responses it could not encode; by that point it has already
+// written the appropriate HTTP status code, so serveAdmitFunc does not override it.
 func serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 	log.Print("Handling webhook request ...")
 
 	var writeErr error
 	if bytes, err := doServeAdmitFunc(w, r, admit); err != nil {
-		log.Printf("Error handling webhook request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Rejected webhook request: %v", err)
 		_, writeErr = w.Write([]byte(err.Error()))
 	} else {
 		log.Print("Webhook request handled successfully")
@@ -0,0 +1,45 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewFieldError constructs a Response denying the request with a single per-field validation cause attached to
+// Result.Details, the shape kubectl renders for structured field-validation errors.
+func NewFieldError(path, reason string) Response {
+	resp := Denied(reason)
+	resp.Result = &metav1.Status{
+		Message: reason,
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Details: &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{
+				{
+					Type:    metav1.CauseTypeFieldValueInvalid,
+					Message: reason,
+					Field:   path,
+				},
+			},
+		},
+	}
+	return resp
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	jsonpatch "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Response is a version-agnostic wrapper around an outgoing AdmissionResponse. A Handler populates Patches and the
+// embedded AdmissionResponse -- including Warnings, Result, and AuditAnnotations -- and doServeAdmitFunc takes care
+// of encoding it for whichever AdmissionReview apiVersion the request arrived in.
+type Response struct {
+	// Patches are the JSON patch operations to apply. They are only honored when Allowed is true, and are marshaled
+	// into AdmissionResponse.Patch before the response is sent.
+	Patches []patchOperation
+
+	admissionv1.AdmissionResponse
+}
+
+// Handler is implemented by webhook logic that wants typed access to the incoming object instead of hand-crafting
+// JSON patch operations from a raw *admissionv1.AdmissionRequest. It is modeled on controller-runtime's admission
+// package so mutators can be written against familiar types.
+type Handler interface {
+	Handle(ctx context.Context, req Request) Response
+}
+
+// HandlerFunc adapts an ordinary function into a Handler.
+type HandlerFunc func(ctx context.Context, req Request) Response
+
+// Handle calls f(ctx, req).
+func (f HandlerFunc) Handle(ctx context.Context, req Request) Response {
+	return f(ctx, req)
+}
+
+// Decoder decodes the raw Object/OldObject carried by a Request into a typed runtime.Object, using the same
+// universal deserializer doServeAdmitFunc uses to parse the AdmissionReview itself.
+type Decoder struct{}
+
+// NewDecoder returns a ready-to-use Decoder.
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Decode unmarshals req.Object into into.
+func (d *Decoder) Decode(req Request, into runtime.Object) error {
+	return d.DecodeRaw(req.Object, into)
+}
+
+// DecodeRaw unmarshals rawObj into into.
+func (d *Decoder) DecodeRaw(rawObj runtime.RawExtension, into runtime.Object) error {
+	if len(rawObj.Raw) == 0 {
+		return errors.New("cannot decode empty raw object")
+	}
+	_, _, err := universalDeserializer.Decode(rawObj.Raw, nil, into)
+	return err
+}
+
+// Allowed constructs a Response that allows the request, optionally carrying a human-readable message.
+func Allowed(msg string) Response {
+	return ValidationResponse(true, msg)
+}
+
+// Denied constructs a Response that denies the request, carrying msg as the rejection message.
+func Denied(msg string) Response {
+	return ValidationResponse(false, msg)
+}
+
+// ValidationResponse constructs a Response with the given allowed state and message.
+func ValidationResponse(allowed bool, msg string) Response {
+	resp := Response{AdmissionResponse: admissionv1.AdmissionResponse{Allowed: allowed}}
+	if msg != "" {
+		resp.Result = &metav1.Status{Message: msg}
+	}
+	return resp
+}
+
+// Errored constructs a Response that denies the request and reports err under the given status code.
+func Errored(code int32, err error) Response {
+	return Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Code:    code,
+				Message: err.Error(),
+			},
+		},
+	}
+}
+
+// PatchResponseFromRaw diffs originalRaw against mutatedJSON and returns an allowed Response carrying the resulting
+// RFC 6902 JSON patch operations, so Handler implementations can mutate a decoded Go object and let the framework
+// figure out the patch instead of building patchOperations by hand.
+func PatchResponseFromRaw(originalRaw, mutatedJSON []byte) Response {
+	diffOps, err := jsonpatch.CreatePatch(originalRaw, mutatedJSON)
+	if err != nil {
+		return Errored(http.StatusInternalServerError, fmt.Errorf("could not create patch: %v", err))
+	}
+
+	ops := make([]patchOperation, 0, len(diffOps))
+	for _, p := range diffOps {
+		ops = append(ops, patchOperation{Op: p.Operation, Path: p.Path, Value: p.Value})
+	}
+	return Response{
+		Patches: ops,
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: true,
+		},
+	}
+}
+
+// admitFuncFromHandler adapts a Handler to the admitFunc signature, applying the WebhookHandler operation filter
+// before calling through to Handle.
+func admitFuncFromHandler(h Handler) admitFunc {
+	return func(req Request) Response {
+		if !operationAllowed(h, req.Operation) {
+			return Allowed("")
+		}
+		return h.Handle(context.Background(), req)
+	}
+}
+
+// handlerHandler takes a Handler and wraps it into a http.Handler, so typed Handlers can be registered on an
+// http.ServeMux alongside the raw admitFuncHandler.
+func handlerHandler(h Handler) http.Handler {
+	return admitFuncHandler(admitFuncFromHandler(h))
+}
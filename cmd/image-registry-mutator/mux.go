@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Rule identifies the requests a registered Handler should receive: a group/version/resource plus the admission
+// Operation and (optional) subresource it applies to, mirroring the "rules" stanza of a
+// MutatingWebhookConfiguration/ValidatingWebhookConfiguration. An empty Group, Version, Resource, Operation, or
+// SubResource matches any value for that field.
+type Rule struct {
+	Group       string
+	Version     string
+	Resource    string
+	Operation   admissionv1.Operation
+	SubResource string
+
+	// LabelSelector, when non-nil, further restricts matching to objects whose labels satisfy the selector.
+	LabelSelector *metav1.LabelSelector
+	// Namespaces, when non-empty, restricts matching to requests in one of the listed namespaces.
+	Namespaces []string
+}
+
+// matches reports whether req satisfies rule.
+func (rule Rule) matches(req Request) bool {
+	gr := req.Resource
+	if rule.Group != "" && rule.Group != gr.Group {
+		return false
+	}
+	if rule.Version != "" && rule.Version != gr.Version {
+		return false
+	}
+	if rule.Resource != "" && rule.Resource != gr.Resource {
+		return false
+	}
+	if rule.Operation != "" && rule.Operation != req.Operation {
+		return false
+	}
+	if rule.SubResource != "" && rule.SubResource != req.SubResource {
+		return false
+	}
+
+	if len(rule.Namespaces) > 0 {
+		found := false
+		for _, ns := range rule.Namespaces {
+			if ns == req.Namespace {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return rule.matchesLabels(req)
+}
+
+// partialObject is just enough of a Kubernetes object to read its labels out of the raw JSON carried by a Request,
+// without needing the concrete Go type registered anywhere.
+type partialObject struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+}
+
+// matchesLabels reports whether the object carried by req satisfies rule.LabelSelector, or true if rule has none.
+func (rule Rule) matchesLabels(req Request) bool {
+	if rule.LabelSelector == nil {
+		return true
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(rule.LabelSelector)
+	if err != nil {
+		return false
+	}
+
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	if len(raw) == 0 {
+		return false
+	}
+
+	var obj partialObject
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(obj.Metadata.Labels))
+}
+
+// registration pairs a Rule with the Handler that serves requests matching it.
+type registration struct {
+	rule    Rule
+	handler Handler
+}
+
+// Mux dispatches an incoming Request to whichever registered Handler matches its GroupVersionResource, Operation,
+// and subresource (plus optional namespace/label selectors), so a single binary can expose many mutators/validators
+// behind one endpoint instead of one admitFunc per route that switches on req.Resource internally.
+//
+// A Mux is itself a Handler, so it can be nested, and an http.Handler, so it can be mounted directly at a path such
+// as "/admit".
+type Mux struct {
+	mu            sync.RWMutex
+	registrations []registration
+
+	// DefaultAllowed controls the response for requests that match no registered rule. It defaults to true (pass
+	// through) via NewMux, so an unconfigured route does not block unrelated admission requests.
+	DefaultAllowed bool
+}
+
+// NewMux returns a Mux that allows requests matching no registered rule by default.
+func NewMux() *Mux {
+	return &Mux{DefaultAllowed: true}
+}
+
+// Register adds h as the Handler for requests matching rule. Rules are consulted in registration order; the first
+// match wins.
+func (m *Mux) Register(rule Rule, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations = append(m.registrations, registration{rule: rule, handler: h})
+}
+
+// Handle implements Handler by dispatching to the first registered Handler whose Rule matches req, or by returning
+// an Allowed/Denied Response per DefaultAllowed if no rule matches.
+func (m *Mux) Handle(ctx context.Context, req Request) Response {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, reg := range m.registrations {
+		if reg.rule.matches(req) {
+			return reg.handler.Handle(ctx, req)
+		}
+	}
+
+	if m.DefaultAllowed {
+		return Allowed("no registered rule matched this request")
+	}
+	return Denied("no registered rule matched this request")
+}
+
+// ServeHTTP lets a Mux be mounted directly at a single admission webhook path, e.g. "/admit".
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handlerHandler(m).ServeHTTP(w, r)
+}
+
+// Rules returns the registered rules in registration order, for introspection or for generating the corresponding
+// MutatingWebhookConfiguration/ValidatingWebhookConfiguration YAML from code instead of hand-maintaining it.
+func (m *Mux) Rules() []Rule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := make([]Rule, 0, len(m.registrations))
+	for _, reg := range m.registrations {
+		rules = append(rules, reg.rule)
+	}
+	return rules
+}
+
+// RulesHandler serves the registered rules as JSON, mountable at an introspection path such as "/admit/rules".
+func (m *Mux) RulesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", jsonContentType)
+		if err := json.NewEncoder(w).Encode(m.Rules()); err != nil {
+			log.Printf("could not encode registered rules: %v", err)
+		}
+	})
+}
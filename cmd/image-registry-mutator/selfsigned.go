@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	admissionregistrationv1client "k8s.io/client-go/kubernetes/typed/admissionregistration/v1"
+)
+
+// GenerateSelfSignedCert generates a self-signed CA and a serving certificate for commonName (typically the
+// webhook's in-cluster Service DNS name, e.g. "image-registry-mutator.default.svc"), valid for validFor, and writes
+// the PEM-encoded serving certificate and key to certFile/keyFile. It returns the PEM-encoded CA certificate, for
+// use as the caBundle of a MutatingWebhookConfiguration/ValidatingWebhookConfiguration. It is meant for local/dev
+// use; production deployments should use a properly managed CA instead.
+func GenerateSelfSignedCert(commonName, certFile, keyFile string, validFor time.Duration) (caBundle []byte, err error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating CA key: %v", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName + "-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(validFor),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating CA certificate: %v", err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CA certificate: %v", err)
+	}
+
+	servingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating serving key: %v", err)
+	}
+
+	servingTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	servingDER, err := x509.CreateCertificate(rand.Reader, servingTemplate, caCert, &servingKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating serving certificate: %v", err)
+	}
+	servingPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingDER})
+	servingKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(servingKey)})
+
+	if err := os.WriteFile(certFile, servingPEM, 0o644); err != nil {
+		return nil, fmt.Errorf("writing serving certificate to %s: %v", certFile, err)
+	}
+	if err := os.WriteFile(keyFile, servingKeyPEM, 0o600); err != nil {
+		return nil, fmt.Errorf("writing serving key to %s: %v", keyFile, err)
+	}
+
+	return caPEM, nil
+}
+
+// PatchCABundle writes caBundle into every webhook entry of the named MutatingWebhookConfiguration, so a
+// self-signed CA generated by GenerateSelfSignedCert can be wired up without operators having to script it
+// themselves.
+func PatchCABundle(ctx context.Context, client admissionregistrationv1client.MutatingWebhookConfigurationInterface, name string, caBundle []byte) error {
+	cfg, err := client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting MutatingWebhookConfiguration %s: %v", name, err)
+	}
+
+	for i := range cfg.Webhooks {
+		cfg.Webhooks[i].ClientConfig.CABundle = caBundle
+	}
+
+	if _, err := client.Update(ctx, cfg, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating MutatingWebhookConfiguration %s: %v", name, err)
+	}
+	return nil
+}
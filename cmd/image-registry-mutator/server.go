@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Server owns an http.Server configured to serve admission webhooks over TLS. It loads its certificate/key pair
+// from CertFile/KeyFile, watches those files with fsnotify, and reloads the in-memory certificate whenever they
+// change -- so rotating the Secret a MutatingWebhookConfiguration's CA bundle is backed by never requires a
+// restart. It also exposes /healthz and /readyz, the latter only reporting ready once a certificate has loaded.
+type Server struct {
+	// Addr is the address to listen on, e.g. ":8443".
+	Addr string
+	// Handler is the http.Handler to serve admission requests with, typically a Mux or the result of
+	// admitFuncHandler/handlerHandler.
+	Handler http.Handler
+	// CertFile and KeyFile are the paths to load the serving certificate/key pair from, and to watch for rotation.
+	CertFile string
+	KeyFile  string
+
+	httpServer *http.Server
+	watcher    *fsnotify.Watcher
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	ready int32 // atomic bool; flips to 1 after the first successful certificate load
+}
+
+// NewServer returns a Server ready to have ListenAndServeTLS called on it.
+func NewServer(addr, certFile, keyFile string, handler http.Handler) *Server {
+	s := &Server{
+		Addr:     addr,
+		Handler:  handler,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: s.getCertificate,
+		},
+	}
+	return s
+}
+
+// ListenAndServeTLS loads the initial certificate, starts watching it for rotation, and serves HTTPS until the
+// server is shut down or a fatal error occurs.
+func (s *Server) ListenAndServeTLS() error {
+	if err := s.loadCertificate(); err != nil {
+		return err
+	}
+	if err := s.watchCertificate(); err != nil {
+		return err
+	}
+	// Certificate and key are supplied via TLSConfig.GetCertificate, not these arguments.
+	return s.httpServer.ListenAndServeTLS("", "")
+}
+
+// Shutdown stops watching the certificate files and gracefully shuts down the underlying http.Server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.watcher != nil {
+		if err := s.watcher.Close(); err != nil {
+			log.Printf("closing certificate watcher: %v", err)
+		}
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("no serving certificate loaded yet")
+	}
+	return s.cert, nil
+}
+
+func (s *Server) loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate/key pair: %v", err)
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+
+	atomic.StoreInt32(&s.ready, 1)
+	log.Printf("loaded serving certificate from %s", s.CertFile)
+	return nil
+}
+
+// watchCertificate reloads the certificate whenever CertFile or KeyFile changes on disk.
+func (s *Server) watchCertificate() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating certificate watcher: %v", err)
+	}
+
+	for _, dir := range watchDirs(s.CertFile, s.KeyFile) {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("watching %s: %v", dir, err)
+		}
+	}
+	s.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Chmod) == 0 {
+					continue
+				}
+				if err := s.loadCertificate(); err != nil {
+					log.Printf("reloading serving certificate: %v", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("certificate watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchDirs returns the distinct parent directories of paths, since fsnotify watches directories rather than
+// individual files (most rotation schemes, e.g. a mounted Secret, replace the file via a directory-level symlink
+// swap that a file-level watch would miss).
+func watchDirs(paths ...string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, p := range paths {
+		dir := filepath.Dir(p)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReadyz only reports ready once at least one certificate load has succeeded.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "serving certificate not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
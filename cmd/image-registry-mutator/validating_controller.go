@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2019      StackRox Inc.
+Copyright (c) 2019-2020 ZHAO Yao <ytinirt@qq.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ValidatingAdmitFunc is a callback for validating admission controller logic. Given a Request, it reports whether
+// the object is allowed, any non-fatal warnings to surface to the caller, and an error that will be shown (and the
+// request denied) if the object is rejected. Unlike admitFunc, it never produces a patch.
+type ValidatingAdmitFunc func(Request) (allowed bool, warnings []string, err error)
+
+// ValidatingHandler is what doServeValidatingAdmitFunc actually drives. It may also implement WebhookHandler to
+// restrict which admission operations it is invoked for, exactly as Handler does on the mutating side.
+type ValidatingHandler interface {
+	Handle(Request) (allowed bool, warnings []string, err error)
+}
+
+// ValidatingHandlerFunc adapts a ValidatingAdmitFunc into a ValidatingHandler with no operation restriction.
+type ValidatingHandlerFunc ValidatingAdmitFunc
+
+// Handle calls f(req).
+func (f ValidatingHandlerFunc) Handle(req Request) (bool, []string, error) {
+	return f(req)
+}
+
+// WebhookHandler is an optional interface a Handler or ValidatingHandler can implement to declare which admission
+// operations it cares about. admitFuncFromHandler and doServeValidatingAdmitFunc use it to short-circuit requests for
+// operations the handler did not register for, responding Allowed: true (with no patch, for the mutating path)
+// rather than invoking the handler.
+type WebhookHandler interface {
+	Operations() []admissionregistrationv1.OperationType
+}
+
+// operationAllowed reports whether h declares interest in op, or true if h does not implement WebhookHandler at all.
+func operationAllowed(h interface{}, op admissionv1.Operation) bool {
+	wh, ok := h.(WebhookHandler)
+	if !ok {
+		return true
+	}
+	for _, o := range wh.Operations() {
+		if o == admissionregistrationv1.OperationAll || string(o) == string(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// doServeValidatingAdmitFunc parses the HTTP request for a validating admission controller webhook, and -- in case
+// of a well-formed request -- delegates the validation logic to the given ValidatingHandler. The response never
+// carries a Patch; it is populated with Warnings and a structured Result with Reason and Code on denial. Requests
+// for operations the handler did not declare interest in (via WebhookHandler) are allowed through without invoking
+// it, mirroring the mutating path.
+func doServeValidatingAdmitFunc(w http.ResponseWriter, r *http.Request, admit ValidatingHandler) ([]byte, error) {
+	req, gvk, err := decodeAdmissionReview(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	admissionReviewResponse := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+		},
+		Response: &admissionv1.AdmissionResponse{
+			UID: req.UID,
+		},
+	}
+
+	if !operationAllowed(admit, req.Operation) {
+		admissionReviewResponse.Response.Allowed = true
+		bytes, err := encodeAdmissionReview(gvk, admissionReviewResponse)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, err
+		}
+		return bytes, nil
+	}
+
+	allowed, warnings, err := admit.Handle(req)
+	admissionReviewResponse.Response.Warnings = warnings
+
+	if err != nil || !allowed {
+		msg := "admission denied"
+		if err != nil {
+			msg = err.Error()
+		}
+		admissionReviewResponse.Response.Allowed = false
+		admissionReviewResponse.Response.Result = &metav1.Status{
+			Message: msg,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+		}
+	} else {
+		admissionReviewResponse.Response.Allowed = true
+	}
+
+	bytes, err := encodeAdmissionReview(gvk, admissionReviewResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// serveValidatingAdmitFunc is a wrapper around doServeValidatingAdmitFunc that adds error handling and logging.
+// doServeValidatingAdmitFunc only returns an error for requests it could not parse or responses it could not encode;
+// by that point it has already written the appropriate HTTP status code, so serveValidatingAdmitFunc does not
+// override it.
+func serveValidatingAdmitFunc(w http.ResponseWriter, r *http.Request, admit ValidatingHandler) {
+	log.Print("Handling validating webhook request ...")
+
+	var writeErr error
+	if bytes, err := doServeValidatingAdmitFunc(w, r, admit); err != nil {
+		log.Printf("Rejected validating webhook request: %v", err)
+		_, writeErr = w.Write([]byte(err.Error()))
+	} else {
+		log.Print("Validating webhook request handled successfully")
+		_, writeErr = w.Write(bytes)
+	}
+
+	if writeErr != nil {
+		log.Printf("Could not write response: %v", writeErr)
+	}
+}
+
+// validatingHandler takes a ValidatingHandler and wraps it into a http.Handler by means of calling
+// serveValidatingAdmitFunc. A bare ValidatingAdmitFunc can be passed in by wrapping it in ValidatingHandlerFunc.
+func validatingHandler(admit ValidatingHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveValidatingAdmitFunc(w, r, admit)
+	})
+}